@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// genericHookPayload covers the handful of JSON shapes GitHub, GitLab, and
+// Bitbucket all use to carry the repository and ref a hook fired for. It is
+// parsed best-effort: providers.Hook only exposes the raw Headers, Payload,
+// and RequestMethod, so repo/ref/event aren't available as typed fields and
+// must be recovered from the payload and headers directly.
+type genericHookPayload struct {
+	Repository struct {
+		FullName string `json:"full_name"`
+		Name     string `json:"name"`
+	} `json:"repository"`
+	Repo string `json:"repo"`
+	Ref  string `json:"ref"`
+}
+
+// repoAndRefFromPayload best-effort extracts the repository's full name and
+// the ref a hook fired for out of payload. Either return value is empty if
+// payload isn't JSON or doesn't carry that field.
+func repoAndRefFromPayload(payload []byte) (repo, ref string) {
+	var p genericHookPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return "", ""
+	}
+
+	repo = p.Repository.FullName
+	if repo == "" {
+		repo = p.Repository.Name
+	}
+	if repo == "" {
+		repo = p.Repo
+	}
+	return repo, p.Ref
+}
+
+// eventHeaders are the headers providers use to name the event a hook fired
+// for, checked in order, case-insensitively.
+var eventHeaders = []string{"X-GitHub-Event", "X-Gitlab-Event", "X-Event-Key"}
+
+// eventFromHeaders best-effort extracts the event name out of the first
+// eventHeaders entry present in headers, or "" if none are.
+func eventFromHeaders(headers map[string]string) string {
+	for _, name := range eventHeaders {
+		for key, value := range headers {
+			if strings.EqualFold(key, name) && value != "" {
+				return value
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// roundTripperFunc adapts a plain function to the http.RoundTripper
+// interface, the same way http.HandlerFunc adapts a function to Handler.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// Use registers a RoundTripper middleware that wraps every subsequent
+// request to an upstream. Middlewares added later wrap those added earlier,
+// so the last one registered runs first. This mirrors gitlab-workhorse's
+// exported RoundTripper extension point.
+func (p *Proxy) Use(rt func(http.RoundTripper) http.RoundTripper) {
+	p.middlewares = append(p.middlewares, rt)
+	p.rebuildTransport()
+}
+
+func (p *Proxy) rebuildTransport() {
+	transport := p.baseTransport
+	for _, mw := range p.middlewares {
+		transport = mw(transport)
+	}
+	p.httpClient.Transport = transport
+}
+
+// RetryRoundTripper retries idempotent hook deliveries on 5xx responses and
+// network errors, with exponential backoff and jitter, up to maxAttempts
+// total tries. The request body is buffered once so it can be replayed.
+func RetryRoundTripper(maxAttempts int, baseDelay time.Duration) func(http.RoundTripper) http.RoundTripper {
+	if maxAttempts <= 0 {
+		maxAttempts = 3
+	}
+	if baseDelay <= 0 {
+		baseDelay = 200 * time.Millisecond
+	}
+
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			var body []byte
+			if req.Body != nil {
+				var err error
+				body, err = io.ReadAll(req.Body)
+				req.Body.Close()
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			var resp *http.Response
+			var err error
+			for attempt := 0; attempt < maxAttempts; attempt++ {
+				if body != nil {
+					req.Body = io.NopCloser(bytes.NewReader(body))
+					req.ContentLength = int64(len(body))
+				}
+
+				resp, err = next.RoundTrip(req)
+				if err == nil && resp.StatusCode < 500 {
+					return resp, nil
+				}
+				if attempt == maxAttempts-1 {
+					break
+				}
+				if resp != nil {
+					resp.Body.Close()
+				}
+
+				backoff := baseDelay * time.Duration(1<<uint(attempt))
+				jitter := time.Duration(rand.Int63n(int64(baseDelay) + 1))
+				time.Sleep(backoff + jitter)
+			}
+
+			return resp, err
+		})
+	}
+}
+
+var (
+	deliveryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "gitwebhookproxy_delivery_duration_seconds",
+		Help: "Duration of webhook deliveries to upstreams.",
+	}, []string{"provider", "upstream", "status"})
+	deliveryTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gitwebhookproxy_delivery_total",
+		Help: "Total webhook deliveries to upstreams.",
+	}, []string{"provider", "upstream", "status"})
+)
+
+func init() {
+	prometheus.MustRegister(deliveryDuration, deliveryTotal)
+}
+
+// MetricsRoundTripper emits delivery latency and status counters labeled by
+// provider and upstream host.
+func MetricsRoundTripper(provider string) func(http.RoundTripper) http.RoundTripper {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			start := time.Now()
+			resp, err := next.RoundTrip(req)
+
+			status := "error"
+			if resp != nil {
+				status = strconv.Itoa(resp.StatusCode)
+			}
+			labels := prometheus.Labels{"provider": provider, "upstream": req.URL.Host, "status": status}
+			deliveryDuration.With(labels).Observe(time.Since(start).Seconds())
+			deliveryTotal.With(labels).Inc()
+
+			return resp, err
+		})
+	}
+}
+
+// LoggingRoundTripper logs each delivery's outcome, keyed by the delivery ID
+// carried in deliveryIDHeader (e.g. "X-GitHub-Delivery"), so a single hook
+// can be traced across retries.
+func LoggingRoundTripper(deliveryIDHeader string) func(http.RoundTripper) http.RoundTripper {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			deliveryID := req.Header.Get(deliveryIDHeader)
+			start := time.Now()
+
+			resp, err := next.RoundTrip(req)
+			if err != nil {
+				log.Printf("Delivery '%s' to '%s' failed after %s: %s", deliveryID, req.URL, time.Since(start), err)
+				return resp, err
+			}
+
+			log.Printf("Delivery '%s' to '%s' completed in %s with status '%s'", deliveryID, req.URL, time.Since(start), resp.Status)
+			return resp, nil
+		})
+	}
+}
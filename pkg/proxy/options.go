@@ -0,0 +1,48 @@
+package proxy
+
+import "time"
+
+// Option configures optional Proxy behaviour, letting NewProxy grow new
+// capabilities (outbound proxying, pre-auth, custom timeouts, ...) without
+// breaking existing callers of the required, positional parameters.
+type Option func(*Proxy)
+
+// WithProxyConfig routes upstream delivery through the given outbound
+// HTTP(S) proxy instead of dialing upstreams directly.
+func WithProxyConfig(cfg *ProxyConfig) Option {
+	return func(p *Proxy) {
+		p.proxyConfig = cfg
+	}
+}
+
+// WithAuthBackend enables a pre-authorization check against an external
+// auth backend before every hook is forwarded upstream. A zero timeout
+// falls back to the default of 10s.
+func WithAuthBackend(url string, timeout time.Duration) Option {
+	return func(p *Proxy) {
+		p.authBackendURL = url
+		if timeout <= 0 {
+			timeout = time.Second * 10
+		}
+		p.authTimeout = timeout
+	}
+}
+
+// WithTimeouts overrides the per-phase timeouts used for upstream delivery.
+// Fields left zero keep their default value; see Timeouts.
+func WithTimeouts(timeouts Timeouts) Option {
+	return func(p *Proxy) {
+		p.timeouts = timeouts.withDefaults()
+	}
+}
+
+// WithMaxResponseBodyBytes caps how much of the upstream's response body is
+// relayed back to the webhook sender. A non-positive value keeps the
+// default of defaultMaxResponseBodyBytes.
+func WithMaxResponseBodyBytes(max int64) Option {
+	return func(p *Proxy) {
+		if max > 0 {
+			p.maxResponseBodyBytes = max
+		}
+	}
+}
@@ -2,7 +2,10 @@ package proxy
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
@@ -15,48 +18,147 @@ import (
 )
 
 type Proxy struct {
-	provider     string
-	upstreamURL  string
-	allowedPaths []string
-	secret       string
-	httpClient   *http.Client
+	router               *Router
+	httpClient           *http.Client
+	proxyConfig          *ProxyConfig
+	authBackendURL       string
+	authMethod           string
+	authTimeout          time.Duration
+	timeouts             Timeouts
+	baseTransport        http.RoundTripper
+	middlewares          []func(http.RoundTripper) http.RoundTripper
+	maxResponseBodyBytes int64
 }
 
-func (p *Proxy) isPathAllowed(path string) bool {
-	// All paths allowed
-	if len(p.allowedPaths) == 0 {
-		return true
+// defaultMaxResponseBodyBytes caps how much of an upstream's response body
+// is relayed back to the webhook sender, protecting against a misbehaving
+// upstream sending back an unbounded body.
+const defaultMaxResponseBodyBytes = 10 * 1024 * 1024
+
+// hopByHopHeaders are stripped when relaying the upstream's response back to
+// the webhook sender, per RFC 7230 section 6.1. Content-Length is stripped
+// too since the body may be truncated at maxResponseBodyBytes.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Content-Length",
+}
+
+func copyResponseHeaders(dst http.Header, src http.Header) {
+	strip := make(map[string]bool, len(hopByHopHeaders))
+	for _, h := range hopByHopHeaders {
+		strip[h] = true
+	}
+	if connection := src.Get("Connection"); connection != "" {
+		for _, token := range strings.Split(connection, ",") {
+			strip[http.CanonicalHeaderKey(strings.TrimSpace(token))] = true
+		}
 	}
 
-	// Check if given passed exists in allowedPaths
-	for _, p := range p.allowedPaths {
-		if strings.TrimSuffix(strings.TrimSpace(p), "/") ==
-			strings.TrimSuffix(strings.TrimSpace(path), "/") {
-			return true
+	for key, values := range src {
+		if strip[http.CanonicalHeaderKey(key)] {
+			continue
+		}
+		for _, value := range values {
+			dst.Add(key, value)
 		}
 	}
-	return false
 }
 
-func (p *Proxy) redirect(hook *providers.Hook, path string) (*http.Response, error) {
+// authHookSummary is the JSON body posted to authBackendURL so that an
+// external auth backend can apply per-repo ACLs, org allowlists, or dynamic
+// secret lookup on top of the route's static secret.
+type authHookSummary struct {
+	Provider string `json:"provider"`
+	Event    string `json:"event"`
+	Repo     string `json:"repo"`
+	Ref      string `json:"ref"`
+}
+
+// summarizeHook builds an authHookSummary for hook, recovering event/repo/ref
+// best-effort from its headers and payload since providers.Hook itself only
+// exposes Headers, Payload, and RequestMethod.
+func summarizeHook(provider string, hook *providers.Hook) authHookSummary {
+	repo, ref := repoAndRefFromPayload(hook.Payload)
+	return authHookSummary{
+		Provider: provider,
+		Event:    eventFromHeaders(hook.Headers),
+		Repo:     repo,
+		Ref:      ref,
+	}
+}
+
+// preAuthorize consults an optional external auth backend before a hook
+// matched to route is forwarded upstream. It returns http.StatusOK with a
+// nil error when no authBackendURL is configured, or when the backend
+// approves the request.
+func (p *Proxy) preAuthorize(r *http.Request, route *Route, hook *providers.Hook) (int, error) {
+	if len(strings.TrimSpace(p.authBackendURL)) == 0 {
+		return http.StatusOK, nil
+	}
+
+	body, err := json.Marshal(summarizeHook(route.Provider, hook))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	authReq, err := http.NewRequest(p.authMethod, strings.TrimSuffix(p.authBackendURL, "/")+r.URL.Path, bytes.NewBuffer(body))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// Forward the hook headers first so the auth backend can re-verify
+	// signatures, dedupe on delivery ID, or branch on event/provider itself,
+	// then set Content-Type last so it isn't overwritten by the hook's own
+	// (e.g. form-encoded) Content-Type.
+	for key, value := range hook.Headers {
+		authReq.Header.Set(key, value)
+	}
+	authReq.Header.Set(providers.ContentTypeHeader, "application/json")
+	authReq.Header.Set("X-GitWebhookProxy-Provider", route.Provider)
+
+	authClient := &http.Client{Timeout: p.authTimeout}
+	resp, err := authClient.Do(authReq)
+	if err != nil {
+		return http.StatusBadGateway, fmt.Errorf("calling auth backend '%s': %s", p.authBackendURL, err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return http.StatusOK, nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return resp.StatusCode, fmt.Errorf("auth backend rejected request with status: %s", resp.Status)
+	default:
+		return http.StatusBadGateway, fmt.Errorf("auth backend '%s' returned unexpected status: %s", p.authBackendURL, resp.Status)
+	}
+}
+
+func (p *Proxy) redirect(route *Route, hook *providers.Hook, path string) (*http.Response, error) {
 	if hook == nil {
 		return nil, errors.New("Cannot redirect with nil Hook")
 	}
 
 	// Parse url to check validity
-	url, err := url.Parse(p.upstreamURL + path)
+	upstream, err := url.Parse(route.UpstreamURL + route.upstreamPath(path))
 	if err != nil {
 		return nil, err
 	}
 
 	// Assign default scheme as http if not specified
-	if url.Scheme == "" {
-		url.Scheme = "http"
+	if upstream.Scheme == "" {
+		upstream.Scheme = "http"
 	}
 
 	// Create Redirect request
 	// TODO: take method as param from original request
-	req, err := http.NewRequest(hook.RequestMethod, url.String(), bytes.NewBuffer(hook.Payload))
+	req, err := http.NewRequest(hook.RequestMethod, upstream.String(), bytes.NewBuffer(hook.Payload))
 
 	if err != nil {
 		return nil, err
@@ -76,15 +178,18 @@ func (p *Proxy) redirect(hook *providers.Hook, path string) (*http.Response, err
 }
 
 func (p *Proxy) proxyRequest(w http.ResponseWriter, r *http.Request, params httprouter.Params) {
-	log.Printf("Proxying Request from '%s', to upstream '%s'\n", r.URL, p.upstreamURL+r.URL.Path)
+	log.Printf("Proxying Request from '%s'\n", r.URL)
 
-	if !p.isPathAllowed(r.URL.Path) {
-		log.Printf("Not allowed to proxy path: '%s'", r.URL.Path)
-		http.Error(w, "Not allowed to proxy path: '"+r.URL.Path+"'", http.StatusForbidden)
+	// Parsing only needs to know the provider's wire format, not which
+	// route the hook will end up matching, so resolve that much first.
+	providerName, ok := p.router.ProviderForPath(r.URL.Path)
+	if !ok {
+		log.Printf("No route configured for path: '%s'", r.URL.Path)
+		http.Error(w, "No route configured for path: '"+r.URL.Path+"'", http.StatusNotFound)
 		return
 	}
 
-	provider, err := providers.NewProvider(p.provider, p.secret)
+	provider, err := providers.NewProvider(providerName, "")
 	if err != nil {
 		log.Printf("Error creating provider: %s", err)
 		http.Error(w, "Error creating Provider", http.StatusInternalServerError)
@@ -98,27 +203,70 @@ func (p *Proxy) proxyRequest(w http.ResponseWriter, r *http.Request, params http
 		return
 	}
 
-	if !provider.Validate(*hook) {
+	route := p.router.Match(r, hook)
+	if route == nil {
+		log.Printf("No route matched request: '%s'", r.URL)
+		http.Error(w, "No route matched request: '"+r.URL.String()+"'", http.StatusNotFound)
+		return
+	}
+
+	if !route.isPathAllowed(r.URL.Path) {
+		log.Printf("Not allowed to proxy path: '%s'", r.URL.Path)
+		http.Error(w, "Not allowed to proxy path: '"+r.URL.Path+"'", http.StatusForbidden)
+		return
+	}
+
+	validator, err := providers.NewProvider(route.Provider, route.Secret)
+	if err != nil {
+		log.Printf("Error creating provider: %s", err)
+		http.Error(w, "Error creating Provider", http.StatusInternalServerError)
+		return
+	}
+
+	if !validator.Validate(*hook) {
 		log.Printf("Eror Validating Hook: %v", err)
 		http.Error(w, "Error validating Hook", http.StatusBadRequest)
 		return
 	}
 
-	resp, errs := p.redirect(hook, r.URL.Path)
-	if errs != nil {
-		log.Printf("Error Redirecting '%s' to upstream '%s': %s\n", r.URL, p.upstreamURL+r.URL.Path, errs)
-		http.Error(w, "Error Redirecting '"+r.URL.String()+"' to upstream '"+p.upstreamURL+r.URL.Path+"'", http.StatusInternalServerError)
+	if status, err := p.preAuthorize(r, route, hook); err != nil {
+		log.Printf("Error pre-authorizing request: %s", err)
+		http.Error(w, "Error pre-authorizing request: "+err.Error(), status)
 		return
 	}
 
-	if resp.StatusCode >= 400 {
-		log.Printf("Error Redirecting '%s' to upstream '%s', Upstream Redirect Status: %s\n", r.URL, p.upstreamURL+r.URL.Path, resp.Status)
-		http.Error(w, "Error Redirecting '"+r.URL.String()+"' to upstream '"+p.upstreamURL+r.URL.Path+"' Upstream Redirect Status:"+resp.Status, resp.StatusCode)
+	proxyDescription := "unknown"
+	if upstream, err := url.Parse(route.UpstreamURL); err != nil {
+		log.Printf("Error parsing upstream URL '%s': %s", route.UpstreamURL, err)
+	} else {
+		if upstream.Scheme == "" {
+			upstream.Scheme = "http"
+		}
+		proxyDescription = p.proxyConfig.describeProxy(upstream)
+	}
+	log.Printf("Redirecting '%s' to upstream '%s' via proxy '%s'\n", r.URL, route.UpstreamURL, proxyDescription)
+
+	resp, errs := p.redirect(route, hook, r.URL.Path)
+	if errs != nil {
+		log.Printf("Error Redirecting '%s' to upstream '%s': %s\n", r.URL, route.UpstreamURL, errs)
+		http.Error(w, "Error Redirecting '"+r.URL.String()+"' to upstream '"+route.UpstreamURL+"'", http.StatusInternalServerError)
 		return
 	}
+	defer resp.Body.Close()
+
+	// Relay the upstream's response (status, headers, body) back to the
+	// webhook sender, so providers like GitHub can show it in their
+	// "Recent Deliveries" UI. The body is capped at maxResponseBodyBytes to
+	// protect against a misbehaving upstream.
+	copyResponseHeaders(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	written, err := io.Copy(w, io.LimitReader(resp.Body, p.maxResponseBodyBytes))
+	if err != nil {
+		log.Printf("Error streaming upstream response body from '%s': %s", route.UpstreamURL, err)
+	}
 
-	log.Printf("Redirected incomming request '%s' to '%s' with Response: '%s'\n",
-		r.URL, p.upstreamURL+r.URL.Path, resp.Status)
+	log.Printf("Redirected incomming request '%s' to '%s' with Response: '%s' (%d response bytes)\n",
+		r.URL, route.UpstreamURL, resp.Status, written)
 }
 
 // Health Check Endpoint
@@ -140,9 +288,39 @@ func (p *Proxy) Run(listenAddress string) error {
 	return http.ListenAndServe(listenAddress, router)
 }
 
-func NewProxy(upstreamURL string, allowedPaths []string,
-	provider string, secret string) (*Proxy, error) {
-	// Validate Params
+// NewProxy creates a Proxy that fans webhooks out across routes, so one
+// deployment can route different paths, providers, or repos to different
+// upstreams. See NewSingleRouteProxy for the single-upstream case.
+func NewProxy(routes []Route, opts ...Option) (*Proxy, error) {
+	router, err := NewRouter(routes)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Proxy{
+		router:               router,
+		authMethod:           http.MethodPost,
+		authTimeout:          time.Second * 10,
+		timeouts:             defaultTimeouts(),
+		maxResponseBodyBytes: defaultMaxResponseBodyBytes,
+	}
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	p.baseTransport = newTransport(p.proxyConfig, p.timeouts)
+	p.httpClient = &http.Client{Timeout: p.timeouts.Overall}
+	p.rebuildTransport()
+
+	return p, nil
+}
+
+// NewSingleRouteProxy builds a Proxy with a single route, matching every
+// path to one upstream, provider and secret. It exists for backwards
+// compatibility with callers from before the routing table was introduced.
+func NewSingleRouteProxy(upstreamURL string, allowedPaths []string,
+	provider string, secret string, opts ...Option) (*Proxy, error) {
 	if len(strings.TrimSpace(secret)) == 0 {
 		return nil, errors.New("Cannot create Proxy with empty secret")
 	}
@@ -156,13 +334,5 @@ func NewProxy(upstreamURL string, allowedPaths []string,
 		return nil, errors.New("Cannot create Proxy with nil allowedPaths")
 	}
 
-	return &Proxy{
-		provider:     provider,
-		upstreamURL:  upstreamURL,
-		allowedPaths: allowedPaths,
-		secret:       secret,
-		httpClient: &http.Client{
-			Timeout: time.Second * 60,
-		},
-	}, nil
+	return NewProxy(singleRouteTable(upstreamURL, allowedPaths, provider, secret), opts...)
 }
@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/stakater/GitWebhookProxy/pkg/providers"
+	"gopkg.in/yaml.v2"
+)
+
+// Route describes one fan-out target: hooks matching Provider, PathPrefix,
+// and RepoRegex are validated against Secret and forwarded to UpstreamURL,
+// restricted to AllowedPaths (if any). This lets a single deployment fan
+// webhooks out to multiple CI/CD systems, e.g. "/jenkins/*" to Jenkins,
+// "/drone/*" to Drone, or different repos to different Jenkins instances.
+type Route struct {
+	Provider     string   `json:"provider" yaml:"provider"`
+	PathPrefix   string   `json:"pathPrefix" yaml:"pathPrefix"`
+	RepoRegex    string   `json:"repoRegex" yaml:"repoRegex"`
+	UpstreamURL  string   `json:"upstreamURL" yaml:"upstreamURL"`
+	Secret       string   `json:"secret" yaml:"secret"`
+	AllowedPaths []string `json:"allowedPaths" yaml:"allowedPaths"`
+}
+
+// upstreamPath returns the portion of path to append to UpstreamURL: path
+// with the matched PathPrefix stripped, so e.g. a "/jenkins" route forwards
+// "/jenkins/build1" as "/build1" instead of replaying the prefix upstream.
+func (route *Route) upstreamPath(path string) string {
+	remainder := strings.TrimPrefix(path, route.PathPrefix)
+	if !strings.HasPrefix(remainder, "/") {
+		remainder = "/" + remainder
+	}
+	return remainder
+}
+
+func (route *Route) isPathAllowed(path string) bool {
+	// All paths allowed
+	if len(route.AllowedPaths) == 0 {
+		return true
+	}
+
+	for _, allowed := range route.AllowedPaths {
+		if strings.TrimSuffix(strings.TrimSpace(allowed), "/") ==
+			strings.TrimSuffix(strings.TrimSpace(path), "/") {
+			return true
+		}
+	}
+	return false
+}
+
+type compiledRoute struct {
+	Route
+	repoRegex *regexp.Regexp
+}
+
+// Router holds the compiled routing table used to fan webhooks out to
+// multiple upstreams, keyed by path prefix, provider, and repo.
+type Router struct {
+	routes []compiledRoute
+}
+
+// NewRouter compiles routes into a Router, validating each RepoRegex.
+func NewRouter(routes []Route) (*Router, error) {
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("Cannot create Router with no routes")
+	}
+
+	compiled := make([]compiledRoute, 0, len(routes))
+	for _, route := range routes {
+		if len(strings.TrimSpace(route.Secret)) == 0 {
+			return nil, fmt.Errorf("Cannot create Route '%s' with empty secret", route.PathPrefix)
+		}
+		if len(strings.TrimSpace(route.UpstreamURL)) == 0 {
+			return nil, fmt.Errorf("Cannot create Route '%s' with empty upstreamURL", route.PathPrefix)
+		}
+		if len(strings.TrimSpace(route.Provider)) == 0 {
+			return nil, fmt.Errorf("Cannot create Route '%s' with empty provider", route.PathPrefix)
+		}
+
+		cr := compiledRoute{Route: route}
+		if len(strings.TrimSpace(route.RepoRegex)) > 0 {
+			re, err := regexp.Compile(route.RepoRegex)
+			if err != nil {
+				return nil, fmt.Errorf("compiling RepoRegex '%s' for route '%s': %s", route.RepoRegex, route.PathPrefix, err)
+			}
+			cr.repoRegex = re
+		}
+		compiled = append(compiled, cr)
+	}
+
+	return &Router{routes: compiled}, nil
+}
+
+// ProviderForPath returns the provider type of the first route whose
+// PathPrefix matches path, so a hook can be parsed before its repo/org
+// fields are available for the full Match below.
+func (router *Router) ProviderForPath(path string) (string, bool) {
+	for _, route := range router.routes {
+		if strings.HasPrefix(path, route.PathPrefix) {
+			return route.Provider, true
+		}
+	}
+	return "", false
+}
+
+// Match finds the route for r, keeping only routes of the provider the hook
+// was parsed as (see ProviderForPath), and refining on the repo a hook fired
+// for (once it's known, from the parsed payload) when a route has a RepoRegex.
+func (router *Router) Match(r *http.Request, hook *providers.Hook) *Route {
+	provider, _ := router.ProviderForPath(r.URL.Path)
+	for i := range router.routes {
+		route := &router.routes[i]
+		if !strings.HasPrefix(r.URL.Path, route.PathPrefix) {
+			continue
+		}
+		if route.Provider != provider {
+			continue
+		}
+		if route.repoRegex != nil {
+			repo, _ := repoAndRefFromPayload(hook.Payload)
+			if !route.repoRegex.MatchString(repo) {
+				continue
+			}
+		}
+		return &route.Route
+	}
+	return nil
+}
+
+// singleRouteTable builds a one-route table from the flat parameters
+// GitWebhookProxy originally took, for NewSingleRouteProxy's backwards
+// compatibility with existing callers.
+func singleRouteTable(upstreamURL string, allowedPaths []string, provider string, secret string) []Route {
+	return []Route{{
+		Provider:     provider,
+		PathPrefix:   "/",
+		UpstreamURL:  upstreamURL,
+		Secret:       secret,
+		AllowedPaths: allowedPaths,
+	}}
+}
+
+// LoadRoutesFromFile reads a routing table from a YAML or JSON file (chosen
+// by extension), so operators can reload routes without recompiling.
+func LoadRoutesFromFile(path string) ([]Route, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading routes file '%s': %s", path, err)
+	}
+
+	var routes []Route
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &routes)
+	case ".json":
+		err = json.Unmarshal(data, &routes)
+	default:
+		return nil, fmt.Errorf("unsupported routes file extension '%s'", ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing routes file '%s': %s", path, err)
+	}
+
+	return routes, nil
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// Timeouts breaks the single request-wide deadline into the phases that
+// actually matter for large payloads (e.g. GitLab push events with many
+// commits) and slow upstreams (e.g. Jenkins under load), instead of
+// conflating them into one ceiling.
+type Timeouts struct {
+	// Connect bounds the TCP dial to the upstream (or proxy).
+	Connect time.Duration
+	// TLSHandshake bounds completing the TLS handshake.
+	TLSHandshake time.Duration
+	// ResponseHeader bounds waiting for the upstream's response headers
+	// after the request has been written.
+	ResponseHeader time.Duration
+	// ExpectContinue bounds waiting for a 100-continue response when a
+	// request carries "Expect: 100-continue".
+	ExpectContinue time.Duration
+	// IdleConn bounds how long an idle keep-alive connection is kept in
+	// the pool before being closed.
+	IdleConn time.Duration
+	// Overall bounds the entire round trip, from dial to the last response
+	// byte. This is http.Client.Timeout.
+	Overall time.Duration
+}
+
+// defaultTimeouts returns the default per-phase timeouts: 5s/5s/30s/1s/90s/60s.
+// Overall keeps the single 60s deadline GitWebhookProxy used before Timeouts
+// existed.
+func defaultTimeouts() Timeouts {
+	return Timeouts{
+		Connect:        5 * time.Second,
+		TLSHandshake:   5 * time.Second,
+		ResponseHeader: 30 * time.Second,
+		ExpectContinue: 1 * time.Second,
+		IdleConn:       90 * time.Second,
+		Overall:        60 * time.Second,
+	}
+}
+
+// withDefaults fills any zero-valued field with its default, so callers can
+// only override the phases they care about.
+func (t Timeouts) withDefaults() Timeouts {
+	defaults := defaultTimeouts()
+
+	if t.Connect <= 0 {
+		t.Connect = defaults.Connect
+	}
+	if t.TLSHandshake <= 0 {
+		t.TLSHandshake = defaults.TLSHandshake
+	}
+	if t.ResponseHeader <= 0 {
+		t.ResponseHeader = defaults.ResponseHeader
+	}
+	if t.ExpectContinue <= 0 {
+		t.ExpectContinue = defaults.ExpectContinue
+	}
+	if t.IdleConn <= 0 {
+		t.IdleConn = defaults.IdleConn
+	}
+	if t.Overall <= 0 {
+		t.Overall = defaults.Overall
+	}
+
+	return t
+}
+
+func (t Timeouts) applyTo(transport *http.Transport) {
+	transport.DialContext = (&net.Dialer{
+		Timeout: t.Connect,
+	}).DialContext
+	transport.TLSHandshakeTimeout = t.TLSHandshake
+	transport.ResponseHeaderTimeout = t.ResponseHeader
+	transport.ExpectContinueTimeout = t.ExpectContinue
+	transport.IdleConnTimeout = t.IdleConn
+}
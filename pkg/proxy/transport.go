@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ProxyConfig configures the outbound HTTP(S) proxy GitWebhookProxy dials
+// through to reach upstreams, for operators running in air-gapped or
+// egress-controlled environments (e.g. behind Squid or a corporate proxy).
+type ProxyConfig struct {
+	// HTTPProxyURL is used when redirecting to a plain http upstream.
+	HTTPProxyURL string
+	// HTTPSProxyURL is used when redirecting to an https upstream, via an
+	// explicit CONNECT tunnel.
+	HTTPSProxyURL string
+	// NoProxy is a comma-separated list of hostnames/suffixes that should
+	// bypass the proxy entirely, mirroring the usual NO_PROXY convention.
+	NoProxy string
+	// UseEnvProxy falls back to http.ProxyFromEnvironment (HTTP_PROXY,
+	// HTTPS_PROXY, NO_PROXY) for any scheme left unset above.
+	UseEnvProxy bool
+	// ConnectTimeout bounds dialing the proxy and completing the CONNECT
+	// handshake, separately from the overall request timeout.
+	ConnectTimeout time.Duration
+}
+
+// connectTimeout returns the configured proxy-connect timeout, or fallback
+// (the unified Timeouts.Connect) when ConnectTimeout wasn't explicitly set,
+// so the two knobs don't silently diverge.
+func (c *ProxyConfig) connectTimeout(fallback time.Duration) time.Duration {
+	if c == nil || c.ConnectTimeout <= 0 {
+		return fallback
+	}
+	return c.ConnectTimeout
+}
+
+// proxyURLFor resolves which proxy, if any, should be used to reach target.
+// A nil return means the connection should be made directly.
+func (c *ProxyConfig) proxyURLFor(target *url.URL) (*url.URL, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	if noProxyMatches(c.NoProxy, target.Hostname()) {
+		return nil, nil
+	}
+
+	raw := c.HTTPProxyURL
+	if target.Scheme == "https" {
+		raw = c.HTTPSProxyURL
+	}
+
+	if strings.TrimSpace(raw) == "" {
+		if !c.UseEnvProxy {
+			return nil, nil
+		}
+		return http.ProxyFromEnvironment(&http.Request{URL: target})
+	}
+
+	return url.Parse(raw)
+}
+
+func noProxyMatches(noProxy, host string) bool {
+	for _, suffix := range strings.Split(noProxy, ",") {
+		suffix = strings.TrimSpace(suffix)
+		if suffix == "" {
+			continue
+		}
+		if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// describeProxy returns a short, loggable description of the proxy (if any)
+// that will be used to reach target, so operators can debug misrouted egress.
+func (c *ProxyConfig) describeProxy(target *url.URL) string {
+	proxyURL, err := c.proxyURLFor(target)
+	if err != nil {
+		return fmt.Sprintf("proxy lookup error: %s", err)
+	}
+	if proxyURL == nil {
+		return "direct"
+	}
+	return proxyURL.Host
+}
+
+// newTransport builds an *http.Transport honouring cfg and timeouts. Plain
+// http upstreams are routed through the proxy using the standard Proxy
+// field; https upstreams go through an explicit CONNECT tunnel so that the
+// handshake, Proxy-Authorization header, and TLS ServerName are all under
+// our control.
+func newTransport(cfg *ProxyConfig, timeouts Timeouts) *http.Transport {
+	transport := &http.Transport{
+		Proxy: func(r *http.Request) (*url.URL, error) {
+			// https upstreams are tunnelled by DialTLS below; returning a
+			// proxy here would make net/http do its own CONNECT instead.
+			if r.URL.Scheme == "https" {
+				return nil, nil
+			}
+			return cfg.proxyURLFor(r.URL)
+		},
+		DialTLS: func(network, addr string) (net.Conn, error) {
+			return dialTLSThroughProxy(cfg, addr, timeouts.Connect, timeouts.TLSHandshake)
+		},
+	}
+	timeouts.applyTo(transport)
+	return transport
+}
+
+// dialTLSThroughProxy establishes a TLS connection to addr, tunnelling
+// through cfg's configured HTTPS proxy via CONNECT when one applies, or
+// dialing directly (bounded by connectTimeout) otherwise. The TLS handshake
+// itself is bounded by tlsHandshakeTimeout: installing a custom DialTLS
+// makes Go ignore Transport.TLSHandshakeTimeout, so we enforce it ourselves.
+func dialTLSThroughProxy(cfg *ProxyConfig, addr string, connectTimeout, tlsHandshakeTimeout time.Duration) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	proxyURL, err := cfg.proxyURLFor(&url.URL{Scheme: "https", Host: addr})
+	if err != nil {
+		return nil, err
+	}
+
+	if proxyURL == nil {
+		dialer := &net.Dialer{Timeout: connectTimeout}
+		rawConn, err := dialer.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return tlsHandshake(rawConn, host, tlsHandshakeTimeout)
+	}
+
+	timeout := cfg.connectTimeout(connectTimeout)
+	conn, err := net.DialTimeout("tcp", proxyURL.Host, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("dialing proxy '%s': %w", proxyURL.Host, err)
+	}
+
+	connectReq := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		connectReq.Header.Set("Proxy-Authorization", "Basic "+basicAuth(proxyURL.User))
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := connectReq.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("writing CONNECT to proxy '%s': %w", proxyURL.Host, err)
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), connectReq)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading CONNECT response from proxy '%s': %w", proxyURL.Host, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy '%s' refused CONNECT to '%s': %s", proxyURL.Host, addr, resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+
+	tlsConn, err := tlsHandshake(conn, host, tlsHandshakeTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("TLS handshake with '%s' via proxy '%s': %w", addr, proxyURL.Host, err)
+	}
+	return tlsConn, nil
+}
+
+// tlsHandshake performs a TLS client handshake over conn, bounded by
+// timeout. A custom DialTLS (as newTransport installs) makes Go ignore
+// Transport.TLSHandshakeTimeout, so callers must enforce it themselves via
+// this helper instead.
+func tlsHandshake(conn net.Conn, serverName string, timeout time.Duration) (net.Conn, error) {
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: serverName})
+	if timeout > 0 {
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+func basicAuth(u *url.Userinfo) string {
+	password, _ := u.Password()
+	return base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+}